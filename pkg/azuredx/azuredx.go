@@ -1,32 +1,36 @@
 package azuredx
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
 	"time"
 
+	"github.com/Azure/azure-kusto-go/kusto"
+	kustoerrors "github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/data/table"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
 	"github.com/google/uuid"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/hashicorp/go-hclog"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/clientcredentials"
-	"golang.org/x/oauth2/microsoft"
 )
 
 // QueryModel contains the query information from the API call that we use to make a query.
 type QueryModel struct {
-	Format      string `json:"resultFormat"`
+	Format string `json:"resultFormat"`
+	// QueryType is either "query" (the default) or QueryTypeMgmt ("mgmt") to route the
+	// request through Client.KustoMgmt instead of Client.KustoRequest.
 	QueryType   string `json:"queryType"`
 	Query       string `json:"query"`
 	Database    string `json:"database"`
 	QuerySource string `json:"querySource"` // used to identify if query came from getSchema, raw mode, etc
 	MacroData   MacroData
+
+	// QueryTimeout optionally overrides the datasource's configured server execution
+	// timeout for this one query, e.g. "2m". Empty means use the datasource default.
+	QueryTimeout string `json:"queryTimeout,omitempty"`
 }
 
 // Interpolate applys macro expansion on the QueryModel's Payload's Query string
@@ -35,6 +39,19 @@ func (qm *QueryModel) Interpolate() (err error) {
 	return
 }
 
+// ServerTimeout parses QueryTimeout, when set, into the MS Timespan string used for the
+// servertimeout connection property so it can override the datasource-level default.
+func (qm *QueryModel) ServerTimeout() (string, error) {
+	if qm.QueryTimeout == "" {
+		return "", nil
+	}
+	d, err := time.ParseDuration(qm.QueryTimeout)
+	if err != nil {
+		return "", fmt.Errorf("invalid queryTimeout %q: %w", qm.QueryTimeout, err)
+	}
+	return formatTimeout(d)
+}
+
 // dataSourceData holds the datasource configuration information for Azure Data Explorer's API
 // that is needed to execute a request against Azure's Data Explorer API.
 type dataSourceData struct {
@@ -43,6 +60,15 @@ type dataSourceData struct {
 	ClusterURL      string `json:"clusterUrl"`
 	DefaultDatabase string `json:"defaultDatabase"`
 	Secret          string `json:"-"`
+
+	// AuthType selects which credential (client secret, managed identity, workload
+	// identity, or Azure CLI) is used to obtain AAD tokens. Defaults to AuthTypeClientSecret.
+	AuthType AuthType `json:"authType"`
+
+	// AzureCloud selects the sovereign Azure cloud (public, US Government, China) the AAD
+	// authority and Kusto resource/audience are resolved for. Defaults to AzurePublic.
+	AzureCloud AzureCloud `json:"azureCloud"`
+
 	DataConsistency string `json:"dataConsistency"`
 	CacheMaxAge     string `json:"cacheMaxAge"`
 	DynamicCaching  bool   `json:"dynamicCaching"`
@@ -57,11 +83,17 @@ type dataSourceData struct {
 	// ServerTimeoutValue is the QueryTimeout formatted as a MS Timespan
 	// which is used as a connection property option.
 	ServerTimeoutValue string `json:"-"`
+
+	// RetryMaxAttempts caps how many attempts in total (the first one included) a retryable
+	// query/mgmt request gets before the final attempt's error/response is returned to the
+	// caller. 0 or less means use defaultMaxRetryAttempts.
+	RetryMaxAttempts int `json:"retryMaxAttempts"`
 }
 
-// Client is an http.Client used for API requests.
+// Client wraps the official Azure Kusto Go SDK client and is used to issue queries,
+// management commands, and ingestion requests against Azure Data Explorer.
 type Client struct {
-	*http.Client
+	kusto *kusto.Client
 	*dataSourceData
 	Log hclog.Logger
 }
@@ -109,28 +141,41 @@ func newDataSourceData(dInfo *backend.DataSourceInstanceSettings) (*dataSourceDa
 		return nil, err
 	}
 
+	if err := validateClusterURL(d.ClusterURL); err != nil {
+		return nil, err
+	}
+
 	d.Secret = dInfo.DecryptedSecureJSONData["clientSecret"]
 	return &d, nil
 }
 
 // NewConnectionProperties creates ADX connection properties based on datasource settings.
-func NewConnectionProperties(c *Client, cs *CacheSettings) *Properties {
+// queryTimeout, when non-empty, is an MS Timespan string (see formatTimeout) that overrides
+// the datasource's configured server execution timeout for a single query.
+func NewConnectionProperties(c *Client, cs *CacheSettings, queryTimeout string) *Properties {
 	cacheMaxAge := c.CacheMaxAge
 	if cs != nil {
 		cacheMaxAge = cs.CacheMaxAge
 	}
 
+	serverTimeout := c.ServerTimeoutValue
+	if queryTimeout != "" {
+		serverTimeout = queryTimeout
+	}
+
 	return &Properties{
 		&options{
 			DataConsistency: c.DataConsistency,
 			CacheMaxAge:     cacheMaxAge,
-			ServerTimeout:   c.ServerTimeoutValue,
+			ServerTimeout:   serverTimeout,
 		},
 	}
 }
 
-// NewClient creates a new Azure Data Explorer http client from the DatasourceInfo.
-// AAD OAuth authentication is setup for the client.
+// NewClient creates a new Azure Data Explorer client from the DatasourceInfo.
+// AAD OAuth authentication is setup for the client, and query/management requests
+// are delegated to the official Kusto Go SDK, which gives us retry/throttle handling,
+// progressive frame parsing and richer error typing for free.
 func NewClient(ctx context.Context, dInfo *backend.DataSourceInstanceSettings) (*Client, error) {
 	c := Client{}
 	var err error
@@ -139,32 +184,19 @@ func NewClient(ctx context.Context, dInfo *backend.DataSourceInstanceSettings) (
 		return nil, err
 	}
 
-	conf := clientcredentials.Config{
-		ClientID:     c.ClientID,
-		ClientSecret: c.Secret,
-		TokenURL:     microsoft.AzureADEndpoint(c.TenantID).TokenURL,
-		Scopes:       []string{"https://kusto.kusto.windows.net/.default"},
+	tokenSource, err := c.dataSourceData.newTokenSource(ctx)
+	if err != nil {
+		return nil, err
 	}
+	authClient := oauth2.NewClient(ctx, tokenSource)
+	authClient.Transport = newRetryableTransport(authClient.Transport, c.RetryMaxAttempts)
 
-	// I hope this correct? The goal is to have a timeout for the
-	// the client that talks to the actual Data explorer API.
-	// One can attach a a variable, oauth2.HTTPClient, to the context of conf.Client(),
-	// but that is the timeout for the token retrieval I believe.
-	// https://github.com/golang/oauth2/issues/206
-	// https://github.com/golang/oauth2/issues/368
-	authClient := oauth2.NewClient(ctx, conf.TokenSource(ctx))
-
-	c.Client = &http.Client{
-		Transport: authClient.Transport,
-		// We add five seconds to the timeout so the client does not timeout before the server.
-		// This is because the QueryTimeout property is used to set the server execution timeout
-		// for queries. The server execution timeout does not apply to retrieving data, so when
-		// a query returns a large amount of data, timeouts will still occur while the data is
-		// being downloaded.
-		// In the future, if we get the timeout value from Grafana's data source proxy setting, we
-		// may have to flip this to subtract time.
-		Timeout: c.dataSourceData.QueryTimeout + 5*time.Second,
+	kcsb := kusto.NewConnectionStringBuilder(c.ClusterURL).WithTokenCredential(tokenCredentialAdapter{tokenSource})
+	kc, err := kusto.New(kcsb, kusto.WithHttpClient(authClient))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kusto client: %w", err)
 	}
+	c.kusto = kc
 
 	return &c, nil
 }
@@ -189,94 +221,118 @@ func formatTimeout(d time.Duration) (string, error) {
 	return fmt.Sprintf("00:%02.0f:%02.0f)", tMinutes.Minutes(), tSeconds.Seconds()), nil
 }
 
+// parseTimeout parses an MS Timespan string of the form "HH:MM:SS" (as produced by
+// formatTimeout) back into a time.Duration. It exists because the servertimeout connection
+// property is carried around as a Timespan string, but the SDK's ServerTimeout QueryOption
+// takes a time.Duration.
+func parseTimeout(s string) (time.Duration, error) {
+	var h, m, sec int
+	if _, err := fmt.Sscanf(s, "%d:%d:%d", &h, &m, &sec); err != nil {
+		return 0, fmt.Errorf("invalid server timeout %q: %w", s, err)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second, nil
+}
+
 // TestRequest handles a data source test request in Grafana's Datasource configuration UI.
+// `.show databases schema` is a management (control) command, not a query, so it goes
+// through KustoMgmt.
 func (c *Client) TestRequest() error {
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(RequestPayload{
-		CSL:        ".show databases schema",
-		DB:         c.DefaultDatabase,
-		Properties: NewConnectionProperties(c, nil),
-	})
-	if err != nil {
-		return err
-	}
-	resp, err := c.Post(c.ClusterURL+"/v1/rest/query", "application/json", &buf)
+	_, errMsg, err := c.KustoMgmt(context.Background(), RequestPayload{
+		CSL: ".show databases schema",
+		DB:  c.DefaultDatabase,
+	}, "testrequest")
 	if err != nil {
+		if errMsg != "" {
+			return fmt.Errorf("%v: %w", errMsg, err)
+		}
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode > 299 {
-		return fmt.Errorf("HTTP error: %v", resp.Status)
-	}
 	return nil
 }
 
-// KustoRequest executes a Kusto Query language request to Azure's Data Explorer V1 REST API
-// and returns a TableResponse. If there is a query syntax error, the error message inside
-// the API's JSON error response is returned as well (if available).
-func (c *Client) KustoRequest(payload RequestPayload, querySource string) (*TableResponse, string, error) {
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(payload)
-	if err != nil {
-		return nil, "", err
-	}
-	req, err := http.NewRequest(http.MethodPost, c.ClusterURL+"/v1/rest/query", &buf)
-	if err != nil {
-		return nil, "", err
-	}
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-ms-app", "Grafana-ADX")
+// KustoRequest executes a Kusto Query language request against Azure Data Explorer via the
+// SDK's Query API and returns a TableResponse. ctx is honored for cancellation and deadlines
+// (e.g. a dashboard panel cancel or alert evaluation deadline), so the in-flight request is
+// aborted as soon as Grafana gives up on it rather than running to a fixed client timeout.
+// If there is a query syntax error, the error message from the SDK's richer error type is
+// returned as well (if available).
+func (c *Client) KustoRequest(ctx context.Context, payload RequestPayload, querySource string) (*TableResponse, string, error) {
 	if querySource == "" {
 		querySource = "unspecified"
 	}
-	req.Header.Set("x-ms-client-request-id", fmt.Sprintf("KGC.%v;%v", querySource, uuid.Must(uuid.NewRandom()).String()))
-	resp, err := c.Do(req)
-	if err != nil {
-		return nil, "", err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode > 299 {
-		bodyBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, "", err
-		}
-		bodyString := string(bodyBytes)
-		if resp.StatusCode == 401 { // 401 does not have a JSON body
-			return nil, "", fmt.Errorf("HTTP error: %v - %v", resp.Status, bodyString)
-		}
-		errorData := &errorResponse{}
-		err = json.Unmarshal(bodyBytes, errorData)
+
+	clientRequestID := fmt.Sprintf("KGC.%v;%v", querySource, uuid.Must(uuid.NewRandom()).String())
+	opts := []kusto.QueryOption{kusto.ClientRequestID(clientRequestID)}
+	if payload.Properties != nil && payload.Properties.Options != nil && payload.Properties.Options.ServerTimeout != "" {
+		d, err := parseTimeout(payload.Properties.Options.ServerTimeout)
 		if err != nil {
-			backend.Logger.Debug("failed to unmarshal error body from response", "error", err)
+			return nil, err.Error(), err
 		}
-		return nil, errorData.Error.Message, fmt.Errorf("HTTP error: %v - %v", resp.Status, bodyString)
+		opts = append(opts, kusto.ServerTimeout(d))
+	}
+
+	iter, err := c.kusto.Query(ctx, payload.DB, kql.New("").AddUnsafe(payload.CSL), opts...)
+	if err != nil {
+		return nil, errMessage(err), classifyKustoErr(err)
 	}
-	tr, err := tableFromJSON(resp.Body)
-	return tr, "", err
+	defer iter.Stop()
+
+	tr, err := tableFromRowIterator(iter)
+	if err != nil {
+		return nil, errMessage(err), err
+	}
+	return tr, "", nil
 }
 
-func tableFromJSON(rc io.Reader) (*TableResponse, error) {
-	tr := &TableResponse{}
-	decoder := json.NewDecoder(rc)
-	// Numbers as string (json.Number) so we can keep types as best we can (since the response has 'type' of column)
-	decoder.UseNumber()
-	err := decoder.Decode(tr)
+// tableFromRowIterator drains a kusto.RowIterator's primary result table, progressively
+// appending rows as the SDK streams frames off the wire, into a TableResponse. The table is
+// created up front rather than on the first row, so a query whose result set has zero rows
+// (e.g. a filter that matches nothing) still returns a valid, empty table instead of an
+// error; note that this SDK version only exposes column types via table.Row, so the
+// Columns of a zero-row table are left empty.
+func tableFromRowIterator(iter *kusto.RowIterator) (*TableResponse, error) {
+	tr := &TableResponse{Tables: []Table{{TableName: "Table_0"}}}
+	tbl := &tr.Tables[0]
+	err := iter.Do(func(row *table.Row) error {
+		if tbl.Columns == nil {
+			cols := make([]Column, len(row.ColumnTypes))
+			for i, ct := range row.ColumnTypes {
+				cols[i] = Column{ColumnName: ct.Name, ColumnType: string(ct.Type)}
+			}
+			tbl.Columns = cols
+		}
+		vals := make([]interface{}, len(row.Values))
+		for i, v := range row.Values {
+			vals[i] = v
+		}
+		tbl.Rows = append(tbl.Rows, vals)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if tr.Tables == nil || len(tr.Tables) == 0 {
-		return nil, fmt.Errorf("unable to parse response, parsed response has no tables")
-	}
 	return tr, nil
 }
 
-// errorResponse is a minimal structure of Azure Data Explorer's JSON
-// error body,
-type errorResponse struct {
-	Error struct {
-		Message string `json:"@message"`
-	} `json:"error"`
+// classifyKustoErr turns the SDK's *kustoerrors.Error (which distinguishes control command
+// failures from query failures) into a plain error message suitable for surfacing to the user.
+func classifyKustoErr(err error) error {
+	kErr, ok := err.(*kustoerrors.Error)
+	if !ok {
+		return err
+	}
+	if kErr.Op == kustoerrors.OpMgmt {
+		return fmt.Errorf("control command error: %v", kErr)
+	}
+	return fmt.Errorf("query error: %v", kErr)
+}
+
+// errMessage extracts a user-facing message from a Kusto SDK error, falling back to Error().
+func errMessage(err error) string {
+	if kErr, ok := err.(*kustoerrors.Error); ok {
+		return kErr.Error()
+	}
+	return err.Error()
 }
 
 // AzureFrameMD is a type to populate a Frame's Custom metadata property.
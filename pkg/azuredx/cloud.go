@@ -0,0 +1,108 @@
+package azuredx
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// AzureCloud selects which sovereign Azure cloud the datasource talks to. It determines
+// both the AAD authority tokens are requested from and the Kusto resource/audience those
+// tokens must be scoped to.
+type AzureCloud string
+
+const (
+	// AzurePublic is the commercial, public Azure cloud. This is the default.
+	AzurePublic AzureCloud = "AzurePublic"
+
+	// AzureUSGovernment is the Azure Government cloud.
+	AzureUSGovernment AzureCloud = "AzureUSGovernment"
+
+	// AzureChina is the Azure China (21Vianet) cloud.
+	AzureChina AzureCloud = "AzureChina"
+)
+
+// cloudSettings bundles the AAD authority host and the Kusto resource/audience suffix for
+// one sovereign cloud.
+type cloudSettings struct {
+	aadAuthorityHost string
+	kustoSuffix      string
+}
+
+var cloudSettingsByCloud = map[AzureCloud]cloudSettings{
+	AzurePublic:       {aadAuthorityHost: "https://login.microsoftonline.com", kustoSuffix: ".kusto.windows.net"},
+	AzureUSGovernment: {aadAuthorityHost: "https://login.microsoftonline.us", kustoSuffix: ".kusto.usgovcloudapi.net"},
+	AzureChina:        {aadAuthorityHost: "https://login.chinacloudapi.cn", kustoSuffix: ".kusto.chinacloudapi.cn"},
+}
+
+// resolveCloudSettings returns the cloudSettings for the configured AzureCloud, defaulting
+// to AzurePublic when unset.
+func resolveCloudSettings(cloud AzureCloud) (cloudSettings, error) {
+	if cloud == "" {
+		cloud = AzurePublic
+	}
+	cs, ok := cloudSettingsByCloud[cloud]
+	if !ok {
+		return cloudSettings{}, fmt.Errorf("unknown azureCloud %q", cloud)
+	}
+	return cs, nil
+}
+
+// aadEndpoint returns the oauth2.Endpoint for the given tenant in the given sovereign cloud.
+func (cs cloudSettings) aadEndpoint(tenantID string) oauth2.Endpoint {
+	return oauth2.Endpoint{
+		AuthURL:  cs.aadAuthorityHost + "/" + tenantID + "/oauth2/v2.0/authorize",
+		TokenURL: cs.aadAuthorityHost + "/" + tenantID + "/oauth2/v2.0/token",
+	}
+}
+
+// kustoResource returns the AAD resource/audience ADX access tokens must be scoped
+// to in the given sovereign cloud, e.g. "https://kusto.kusto.windows.net".
+func (cs cloudSettings) kustoResource() string {
+	return "https://kusto" + cs.kustoSuffix
+}
+
+// trustedClusterURLSuffixes enumerates the exact hostname suffixes a ClusterURL is allowed
+// to end with: the Kusto suffix of every sovereign cloud we know how to issue tokens for,
+// plus the multi-factor-auth variant of the public cloud. It is derived from
+// cloudSettingsByCloud so the allow-list can't drift from the audiences tokens are actually
+// scoped to.
+func trustedClusterURLSuffixes() []string {
+	suffixes := []string{"kustomfa.windows.net"}
+	for _, cs := range cloudSettingsByCloud {
+		suffixes = append(suffixes, strings.TrimPrefix(cs.kustoSuffix, "."))
+	}
+	sort.Strings(suffixes)
+	return suffixes
+}
+
+// trustedClusterURL matches ClusterURL values the plugin is allowed to send requests (and
+// therefore its AAD identity's tokens) to. It guards against SSRF via a malicious cluster
+// URL: without it, a datasource admin (or anyone who can edit datasource JSON) could point
+// ClusterURL at an arbitrary internal host and have the plugin's identity make requests to
+// it. Each allowed suffix is an exact, anchored alternative (not a loose "contains kusto."
+// pattern), so e.g. "foo.kusto.evil.com" is rejected.
+var trustedClusterURL = regexp.MustCompile(
+	`^https://[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)*\.(` + strings.Join(quoteSuffixes(trustedClusterURLSuffixes()), "|") + `)(:\d+)?$`,
+)
+
+// quoteSuffixes escapes each suffix for safe inclusion as a regexp alternative.
+func quoteSuffixes(suffixes []string) []string {
+	quoted := make([]string, len(suffixes))
+	for i, s := range suffixes {
+		quoted[i] = regexp.QuoteMeta(s)
+	}
+	return quoted
+}
+
+// validateClusterURL rejects a ClusterURL that doesn't match the trustedClusterURL
+// allow-list of known Kusto cloud suffixes and kustomfa.windows.net.
+func validateClusterURL(clusterURL string) error {
+	if !trustedClusterURL.MatchString(clusterURL) {
+		return fmt.Errorf("clusterUrl %q is not a trusted Azure Data Explorer endpoint", clusterURL)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package azuredx
+
+import "testing"
+
+func TestValidateClusterURL(t *testing.T) {
+	cases := []struct {
+		name       string
+		clusterURL string
+		wantErr    bool
+	}{
+		{"public cloud", "https://mycluster.kusto.windows.net", false},
+		{"public cloud with port", "https://mycluster.kusto.windows.net:443", false},
+		{"us government cloud", "https://mycluster.kusto.usgovcloudapi.net", false},
+		{"china cloud", "https://mycluster.kusto.chinacloudapi.cn", false},
+		{"kustomfa", "https://mycluster.kustomfa.windows.net", false},
+		{"nested subdomain", "https://region.mycluster.kusto.windows.net", false},
+
+		{"lookalike suffix", "https://foo.kusto.evil.com", true},
+		{"lookalike suffix no dot", "https://x.kusto.attacker-internal", true},
+		{"arbitrary internal host", "https://internal-host.example.com", true},
+		{"missing scheme", "mycluster.kusto.windows.net", true},
+		{"http not https", "http://mycluster.kusto.windows.net", true},
+		{"empty", "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateClusterURL(tc.clusterURL)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validateClusterURL(%q) error = %v, wantErr %v", tc.clusterURL, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveCloudSettings(t *testing.T) {
+	if _, err := resolveCloudSettings(""); err != nil {
+		t.Errorf("resolveCloudSettings(\"\") should default to AzurePublic, got error: %v", err)
+	}
+	if _, err := resolveCloudSettings("NotACloud"); err == nil {
+		t.Error("resolveCloudSettings(\"NotACloud\") should return an error")
+	}
+	for _, cloud := range []AzureCloud{AzurePublic, AzureUSGovernment, AzureChina} {
+		cs, err := resolveCloudSettings(cloud)
+		if err != nil {
+			t.Errorf("resolveCloudSettings(%q) returned unexpected error: %v", cloud, err)
+		}
+		if cs.kustoResource() == "" {
+			t.Errorf("resolveCloudSettings(%q) returned empty kustoResource", cloud)
+		}
+	}
+}
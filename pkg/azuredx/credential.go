@@ -0,0 +1,246 @@
+package azuredx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// AuthType selects how the plugin authenticates to Azure AD / Azure Data Explorer.
+type AuthType string
+
+const (
+	// AuthTypeClientSecret authenticates with a configured AAD app registration's client ID
+	// and secret. This is the original, and still the default, authentication mode.
+	AuthTypeClientSecret AuthType = "clientsecret"
+
+	// AuthTypeManagedIdentity authenticates with the system-assigned managed identity of the
+	// host running the plugin, or a user-assigned managed identity when ClientID is set.
+	AuthTypeManagedIdentity AuthType = "msi"
+
+	// AuthTypeWorkloadIdentity authenticates by exchanging a projected Kubernetes service
+	// account token (federated credential) for an AAD token.
+	AuthTypeWorkloadIdentity AuthType = "workloadidentity"
+
+	// AuthTypeAzureCLI authenticates using the token cached by `az login`, for local
+	// development only.
+	AuthTypeAzureCLI AuthType = "azcli"
+)
+
+// imdsTokenEndpoint is Azure Instance Metadata Service's token endpoint, reachable only
+// from inside an Azure VM, App Service, or similar managed-identity-enabled host.
+const imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// newTokenSource builds the oauth2.TokenSource for the configured AuthType, scoped to the
+// AAD authority and Kusto resource/audience of the configured AzureCloud. Every mode
+// returned here is wrapped in a cachingTokenSource, so callers reuse the cached token and
+// only the call that finds it within the refresh lead time waits for a new one.
+func (d *dataSourceData) newTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	cs, err := resolveCloudSettings(d.AzureCloud)
+	if err != nil {
+		return nil, err
+	}
+	resource := cs.kustoResource()
+
+	var ts oauth2.TokenSource
+	switch d.AuthType {
+	case "", AuthTypeClientSecret:
+		conf := clientcredentials.Config{
+			ClientID:     d.ClientID,
+			ClientSecret: d.Secret,
+			TokenURL:     cs.aadEndpoint(d.TenantID).TokenURL,
+			Scopes:       []string{resource + "/.default"},
+		}
+		ts = conf.TokenSource(ctx)
+	case AuthTypeManagedIdentity:
+		ts = &managedIdentityTokenSource{ctx: ctx, clientID: d.ClientID, resource: resource}
+	case AuthTypeWorkloadIdentity:
+		ts = &workloadIdentityTokenSource{ctx: ctx, clientID: d.ClientID, resource: resource, aadEndpoint: cs.aadEndpoint(d.TenantID).TokenURL}
+	case AuthTypeAzureCLI:
+		ts = &azureCLITokenSource{resource: resource}
+	default:
+		return nil, fmt.Errorf("unknown authType %q", d.AuthType)
+	}
+	return newCachingTokenSource(ts), nil
+}
+
+// tokenCredentialAdapter adapts an oauth2.TokenSource, the common interface all of our auth
+// modes (client secret, managed identity, workload identity, Azure CLI) produce, to the
+// azcore.TokenCredential interface the Kusto Go SDK's connection string builder requires.
+type tokenCredentialAdapter struct {
+	src oauth2.TokenSource
+}
+
+func (a tokenCredentialAdapter) GetToken(_ context.Context, _ policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	tok, err := a.src.Token()
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+	return azcore.AccessToken{Token: tok.AccessToken, ExpiresOn: tok.Expiry}, nil
+}
+
+// cachingTokenSource wraps another oauth2.TokenSource with a mutex-guarded cache of the
+// current token, refreshing it 5 minutes before it expires. The refresh is done inline by
+// the Token call that finds the cached token inside that lead time, so that one call waits
+// for the round-trip; every other call is served from the cache.
+type cachingTokenSource struct {
+	mu       sync.Mutex
+	src      oauth2.TokenSource
+	cur      *oauth2.Token
+	leadTime time.Duration
+}
+
+func newCachingTokenSource(src oauth2.TokenSource) oauth2.TokenSource {
+	return &cachingTokenSource{src: src, leadTime: 5 * time.Minute}
+}
+
+// Token returns the cached token if it is still valid outside of the refresh lead time,
+// otherwise it fetches and caches a new one.
+func (c *cachingTokenSource) Token() (*oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cur != nil && time.Until(c.cur.Expiry) > c.leadTime {
+		return c.cur, nil
+	}
+
+	tok, err := c.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	c.cur = tok
+	return tok, nil
+}
+
+// managedIdentityTokenSource fetches tokens from the Azure Instance Metadata Service,
+// using the system-assigned identity unless clientID selects a user-assigned one.
+type managedIdentityTokenSource struct {
+	ctx      context.Context
+	clientID string
+	resource string
+}
+
+func (m *managedIdentityTokenSource) Token() (*oauth2.Token, error) {
+	q := url.Values{}
+	q.Set("api-version", "2018-02-01")
+	q.Set("resource", m.resource)
+	if m.clientID != "" {
+		q.Set("client_id", m.clientID)
+	}
+
+	req, err := http.NewRequestWithContext(m.ctx, http.MethodGet, imdsTokenEndpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("managed identity token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("managed identity token request failed: %v", resp.Status)
+	}
+	return decodeIMDSToken(resp.Body)
+}
+
+// workloadIdentityTokenSource exchanges the federated token file projected into the pod by
+// Azure AD workload identity for an AAD access token.
+type workloadIdentityTokenSource struct {
+	ctx         context.Context
+	clientID    string
+	resource    string
+	aadEndpoint string
+}
+
+func (w *workloadIdentityTokenSource) Token() (*oauth2.Token, error) {
+	tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if tokenFile == "" {
+		return nil, fmt.Errorf("workload identity: AZURE_FEDERATED_TOKEN_FILE is not set")
+	}
+	federatedToken, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("workload identity: failed to read federated token file: %w", err)
+	}
+
+	clientID := w.clientID
+	if v := os.Getenv("AZURE_CLIENT_ID"); v != "" {
+		clientID = v
+	}
+
+	conf := clientcredentials.Config{
+		ClientID: clientID,
+		TokenURL: w.aadEndpoint,
+		Scopes:   []string{w.resource + "/.default"},
+		EndpointParams: url.Values{
+			"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			"client_assertion":      {strings.TrimSpace(string(federatedToken))},
+		},
+	}
+	return conf.TokenSource(w.ctx).Token()
+}
+
+// azureCLITokenSource shells out to `az account get-access-token` so a developer running
+// Grafana locally can authenticate with whatever identity they're already logged in as.
+type azureCLITokenSource struct {
+	resource string
+}
+
+func (a *azureCLITokenSource) Token() (*oauth2.Token, error) {
+	cmd := exec.Command("az", "account", "get-access-token", "--resource", a.resource, "--output", "json")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("az account get-access-token failed: %w", err)
+	}
+
+	var azToken struct {
+		AccessToken string `json:"accessToken"`
+		ExpiresOn   string `json:"expiresOn"`
+	}
+	if err := json.Unmarshal(out, &azToken); err != nil {
+		return nil, fmt.Errorf("failed to parse az cli token output: %w", err)
+	}
+
+	expiry, err := time.ParseInLocation("2006-01-02 15:04:05.000000", azToken.ExpiresOn, time.Local)
+	if err != nil {
+		expiry = time.Now().Add(time.Hour)
+	}
+	return &oauth2.Token{AccessToken: azToken.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// decodeIMDSToken parses the IMDS token endpoint's JSON response into an oauth2.Token.
+// expires_on is a unix timestamp encoded as a string.
+func decodeIMDSToken(body interface{ Read([]byte) (int, error) }) (*oauth2.Token, error) {
+	var imdsResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := json.NewDecoder(body).Decode(&imdsResp); err != nil {
+		return nil, fmt.Errorf("failed to parse IMDS token response: %w", err)
+	}
+	expiresOn, err := strconv.ParseInt(imdsResp.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse IMDS expires_on %q: %w", imdsResp.ExpiresOn, err)
+	}
+	return &oauth2.Token{
+		AccessToken: imdsResp.AccessToken,
+		TokenType:   imdsResp.TokenType,
+		Expiry:      time.Unix(expiresOn, 0),
+	}, nil
+}
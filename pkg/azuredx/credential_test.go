@@ -0,0 +1,83 @@
+package azuredx
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var errBoom = errors.New("boom")
+
+// countingTokenSource returns its configured token on each call and counts how many times it was
+// invoked, so tests can assert on cache hits vs. refreshes.
+type countingTokenSource struct {
+	calls int
+	token *oauth2.Token
+}
+
+func (c *countingTokenSource) Token() (*oauth2.Token, error) {
+	c.calls++
+	return c.token, nil
+}
+
+func TestCachingTokenSourceReusesValidToken(t *testing.T) {
+	src := &countingTokenSource{token: &oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(time.Hour)}}
+	cts := newCachingTokenSource(src)
+
+	for i := 0; i < 3; i++ {
+		tok, err := cts.Token()
+		if err != nil {
+			t.Fatalf("Token() returned error: %v", err)
+		}
+		if tok.AccessToken != "tok" {
+			t.Fatalf("Token() = %q, want %q", tok.AccessToken, "tok")
+		}
+	}
+	if src.calls != 1 {
+		t.Errorf("underlying source called %d times, want 1 (token should be cached)", src.calls)
+	}
+}
+
+func TestCachingTokenSourceRefreshesWithinLeadTime(t *testing.T) {
+	src := &countingTokenSource{token: &oauth2.Token{AccessToken: "stale", Expiry: time.Now().Add(time.Minute)}}
+	cts := newCachingTokenSource(src).(*cachingTokenSource)
+	cts.leadTime = 5 * time.Minute
+
+	if _, err := cts.Token(); err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+	if src.calls != 1 {
+		t.Fatalf("expected 1 call after first Token(), got %d", src.calls)
+	}
+
+	src.token = &oauth2.Token{AccessToken: "fresh", Expiry: time.Now().Add(time.Hour)}
+	tok, err := cts.Token()
+	if err != nil {
+		t.Fatalf("Token() returned error: %v", err)
+	}
+	if src.calls != 2 {
+		t.Errorf("expected a refresh once inside the lead time, underlying source called %d times, want 2", src.calls)
+	}
+	if tok.AccessToken != "fresh" {
+		t.Errorf("Token() = %q, want %q", tok.AccessToken, "fresh")
+	}
+}
+
+func TestCachingTokenSourcePropagatesError(t *testing.T) {
+	src := &erroringTokenSource{err: errBoom}
+	cts := newCachingTokenSource(src)
+
+	if _, err := cts.Token(); err != errBoom {
+		t.Errorf("Token() error = %v, want %v", err, errBoom)
+	}
+}
+
+type erroringTokenSource struct {
+	err error
+}
+
+func (e *erroringTokenSource) Token() (*oauth2.Token, error) {
+	return nil, e.err
+}
@@ -0,0 +1,78 @@
+package azuredx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Azure/azure-kusto-go/kusto"
+	kustoerrors "github.com/Azure/azure-kusto-go/kusto/data/errors"
+	"github.com/Azure/azure-kusto-go/kusto/kql"
+	"github.com/google/uuid"
+)
+
+// QueryTypeMgmt is the QueryModel.QueryType value that routes a query through KustoMgmt
+// instead of KustoRequest, for control commands such as `.show tables` or `.show cluster`.
+const QueryTypeMgmt = "mgmt"
+
+// KustoMgmt executes a Kusto management (control) command against Azure Data Explorer,
+// such as `.show tables`, `.show functions`, `.show cluster`, or an ingestion status
+// command. Unlike KustoRequest, this goes through the SDK's Mgmt API rather than Query,
+// since control commands are not subject to the same query semantics (e.g. they are never
+// cached and some are not idempotent).
+func (c *Client) KustoMgmt(ctx context.Context, payload RequestPayload, querySource string) (*TableResponse, string, error) {
+	if querySource == "" {
+		querySource = "unspecified"
+	}
+
+	clientRequestID := fmt.Sprintf("KGC.%v;%v", querySource, uuid.Must(uuid.NewRandom()).String())
+	iter, err := c.kusto.Mgmt(ctx, payload.DB, kql.New("").AddUnsafe(payload.CSL), kusto.ClientRequestID(clientRequestID))
+	if err != nil {
+		return nil, mgmtErrMessage(err), classifyKustoErr(err)
+	}
+	defer iter.Stop()
+
+	tr, err := tableFromRowIterator(iter)
+	if err != nil {
+		return nil, mgmtErrMessage(err), err
+	}
+	return tr, "", nil
+}
+
+// oneAPIError is a single entry of the `OneApiErrors` array that the mgmt endpoint returns
+// on failure, as opposed to the single `error.@message` shape the query endpoint uses.
+// https://docs.microsoft.com/en-us/azure/data-explorer/kusto/api/rest/response2
+type oneAPIError struct {
+	Error struct {
+		Message string `json:"@message"`
+		Code    string `json:"code"`
+	} `json:"error"`
+}
+
+// oneAPIErrorResponse is the JSON body of a failed mgmt (control command) response.
+type oneAPIErrorResponse struct {
+	OneAPIErrors []oneAPIError `json:"OneApiErrors"`
+}
+
+// mgmtErrMessage extracts a user-facing message from a mgmt-endpoint error. It prefers the
+// OneApiErrors shape the REST mgmt endpoint uses, falling back to the SDK's generic message
+// when the error doesn't carry a REST body in that shape (e.g. a transport-level failure).
+func mgmtErrMessage(err error) string {
+	kErr, ok := err.(*kustoerrors.Error)
+	if !ok {
+		return err.Error()
+	}
+	body := kErr.UnmarshalREST()
+	if body == nil {
+		return kErr.Error()
+	}
+	raw, jsonErr := json.Marshal(body)
+	if jsonErr != nil {
+		return kErr.Error()
+	}
+	var oneAPIErr oneAPIErrorResponse
+	if jsonErr := json.Unmarshal(raw, &oneAPIErr); jsonErr == nil && len(oneAPIErr.OneAPIErrors) > 0 {
+		return oneAPIErr.OneAPIErrors[0].Error.Message
+	}
+	return kErr.Error()
+}
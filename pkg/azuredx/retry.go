@@ -0,0 +1,130 @@
+package azuredx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxRetryAttempts is how many attempts in total (the first one included) a
+// retryable request gets before the final attempt's error/response is returned to the caller.
+const defaultMaxRetryAttempts = 4
+
+// retryableStatusCodes are the ADX response codes that indicate a transient failure worth
+// retrying: 429 (throttled), 503 (service unavailable), and 504 (gateway timeout).
+var retryableStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+// retryableTransport wraps an http.RoundTripper with jittered exponential backoff for
+// POSTs to ADX's query and mgmt endpoints, honoring the x-ms-retry-after /
+// Retry-After headers when ADX tells us how long to wait.
+type retryableTransport struct {
+	next        http.RoundTripper
+	maxAttempts int
+	// sleep is overridable in tests so backoff doesn't slow down the suite.
+	sleep func(time.Duration)
+}
+
+// newRetryableTransport wraps next with retry/backoff behavior. next defaults to
+// http.DefaultTransport when nil, and maxAttempts defaults to defaultMaxRetryAttempts when
+// zero or negative.
+func newRetryableTransport(next http.RoundTripper, maxAttempts int) *retryableTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxRetryAttempts
+	}
+	return &retryableTransport{next: next, maxAttempts: maxAttempts, sleep: time.Sleep}
+}
+
+// RoundTrip retries the request on transient network errors or throttling responses from
+// /v2/rest/query and /v1/rest/mgmt. The x-ms-client-request-id header set by the caller is
+// preserved unchanged across attempts so ADX can correlate retries of the same request.
+func (t *retryableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRetryableRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < t.maxAttempts; attempt++ {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+
+		resp, err = t.next.RoundTrip(req)
+		if err == nil && !retryableStatusCodes[resp.StatusCode] {
+			return resp, nil
+		}
+
+		if attempt == t.maxAttempts-1 {
+			break
+		}
+
+		wait := retryAfter(resp)
+		if wait == 0 {
+			wait = backoffWithJitter(attempt)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		t.sleep(wait)
+	}
+	return resp, err
+}
+
+// isRetryableRequest restricts retries to POSTs against ADX's query and mgmt REST
+// endpoints; the SDK also issues other calls (e.g. ingestion) we don't want to retry
+// blindly here. The command text is not inspected, so every mgmt POST is retried,
+// whether or not the control command is idempotent. Queries go out over the SDK's v2 query endpoint; mgmt (control command)
+// requests remain on v1.
+func isRetryableRequest(req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+	return strings.HasSuffix(req.URL.Path, "/v2/rest/query") || strings.HasSuffix(req.URL.Path, "/v1/rest/mgmt")
+}
+
+// retryAfter reads the x-ms-retry-after or Retry-After header (in seconds) off a response,
+// returning 0 if neither is present or parseable.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	for _, h := range []string{"x-ms-retry-after", "Retry-After"} {
+		if v := resp.Header.Get(h); v != "" {
+			if secs, err := strconv.Atoi(v); err == nil {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+// backoffWithJitter returns the delay before retry attempt n (0-indexed): 500ms, 1s, 2s,
+// 4s, ... doubling each attempt, with +/-25% jitter so concurrent clients don't retry in
+// lockstep.
+func backoffWithJitter(attempt int) time.Duration {
+	base := 500 * time.Millisecond << uint(attempt)
+	jitter := float64(base) * 0.25 * (2*rand.Float64() - 1)
+	return base + time.Duration(jitter)
+}
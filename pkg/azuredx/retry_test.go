@@ -0,0 +1,115 @@
+package azuredx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryableTransportRetriesUntilSuccess(t *testing.T) {
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	rt := newRetryableTransport(http.DefaultTransport, 0)
+	rt.sleep = func(time.Duration) {} // don't slow down the test with real backoff
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v2/rest/query", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected eventual 200, got %v", resp.StatusCode)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryableTransportGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	rt := newRetryableTransport(http.DefaultTransport, 2)
+	rt.sleep = func(time.Duration) {}
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/rest/mgmt", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected transport error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected final attempt's 503 to be returned, got %v", resp.StatusCode)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected exactly maxAttempts (2) attempts, got %d", attempts)
+	}
+}
+
+func TestNewRetryableTransportMaxAttempts(t *testing.T) {
+	cases := []struct {
+		name        string
+		maxAttempts int
+		want        int
+	}{
+		{"configured", 7, 7},
+		{"zero defaults", 0, defaultMaxRetryAttempts},
+		{"negative defaults", -1, defaultMaxRetryAttempts},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := newRetryableTransport(http.DefaultTransport, tc.maxAttempts)
+			if rt.maxAttempts != tc.want {
+				t.Errorf("maxAttempts = %d, want %d", rt.maxAttempts, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsRetryableRequest(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{http.MethodPost, "/v2/rest/query", true},
+		{http.MethodPost, "/v1/rest/mgmt", true},
+		{http.MethodGet, "/v2/rest/query", false},
+		{http.MethodPost, "/v1/rest/query", false},
+		{http.MethodPost, "/v1/ingest", false},
+	}
+	for _, tc := range cases {
+		req, err := http.NewRequest(tc.method, "https://cluster.kusto.windows.net"+tc.path, nil)
+		if err != nil {
+			t.Fatalf("failed to build request: %v", err)
+		}
+		if got := isRetryableRequest(req); got != tc.want {
+			t.Errorf("isRetryableRequest(%s %s) = %v, want %v", tc.method, tc.path, got, tc.want)
+		}
+	}
+}